@@ -0,0 +1,29 @@
+// Copyright (c) 2019 Oragono Authors
+// released under the MIT license
+
+package irc
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// batchCounter is a process-wide rolling counter mixed into batch IDs, so
+// that IDs generated within the same second are still unique without the
+// cost of a cryptographically strong token on every message.
+var batchCounter uint32
+
+// batchCounterMax is where the rolling counter wraps back around to 0.
+const batchCounterMax = 1 << 20
+
+// NewBatchID returns a short batch ID, unique for the lifetime of this
+// server process, suitable for tagging the potentially large number of
+// messages in a history or chathistory playback. It is much cheaper to
+// generate and far shorter on the wire than utils.GenerateSecretToken, but
+// it is not cryptographically unguessable: use utils.GenerateSecretToken for
+// anything security-sensitive.
+func NewBatchID() string {
+	counter := atomic.AddUint32(&batchCounter, 1) % batchCounterMax
+	return strconv.FormatInt(time.Now().Unix(), 36) + strconv.FormatUint(uint64(counter), 36)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Oragono Authors
+// released under the MIT license
+
+// Package caps tracks the IRCv3 client capabilities a session has negotiated.
+package caps
+
+// Capability represents a named IRCv3 client capability that a session can
+// negotiate via CAP REQ.
+type Capability string
+
+// Capabilities referenced by the irc package (see ResponseBuffer). This is
+// not the full capability list the server negotiates, just the ones needed
+// outside of CAP registration itself.
+const (
+	AccountTag      Capability = "account-tag"
+	Batch           Capability = "batch"
+	EventPlayback   Capability = "draft/event-playback"
+	LabeledResponse Capability = "draft/labeled-response-0.2"
+	MaxLine         Capability = "draft/maxline"
+	MessageTags     Capability = "message-tags"
+
+	// LabeledResponseLegacy is the unversioned `draft/labeled-response` name,
+	// advertised alongside LabeledResponse only when a server is configured
+	// to support older clients during the migration to 0.2.
+	LabeledResponseLegacy Capability = "draft/labeled-response"
+
+	// StandardReplies is the `standard-replies` capability: a client
+	// negotiating it understands the machine-readable FAIL/WARN/NOTE verbs,
+	// rather than needing them downgraded to a plain NOTICE.
+	// https://ircv3.net/specs/extensions/standard-replies
+	StandardReplies Capability = "standard-replies"
+
+	// Multiline is the `draft/multiline` capability: a client negotiating it
+	// may have a PRIVMSG/NOTICE body spanning multiple lines reassembled
+	// from, or split into, a `draft/multiline` BATCH.
+	// https://ircv3.net/specs/extensions/multiline
+	Multiline Capability = "draft/multiline"
+)
+
+// LabelTagName is the name of the message tag carrying a draft/label value.
+const LabelTagName = "label"
+
+// Set tracks which capabilities a session has negotiated.
+type Set map[Capability]bool
+
+// NewSet returns a Set with the given capabilities already enabled.
+func NewSet(capabilities ...Capability) Set {
+	set := make(Set, len(capabilities))
+	for _, capability := range capabilities {
+		set[capability] = true
+	}
+	return set
+}
+
+// Has returns whether the set contains the given capability.
+func (set Set) Has(capability Capability) bool {
+	return set[capability]
+}
+
+// Enable adds a capability to the set.
+func (set Set) Enable(capability Capability) {
+	set[capability] = true
+}
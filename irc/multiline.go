@@ -0,0 +1,222 @@
+// Copyright (c) 2019 Oragono Authors
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// Status: this file implements the `draft/multiline` batch-reassembly and
+// limit-enforcement logic (MultilineManager) and the outgoing batch-splitting
+// side (ResponseBuffer.AddMultilineFromClient, in responsebuffer.go). Neither
+// is wired up yet: nothing in this tree slice constructs a MultilineManager
+// per session, calls Start/AddLine/FinishDispatch from a BATCH command
+// handler, or advertises caps.Multiline/MultilineLimits.CapValue() in CAP LS.
+// That wiring belongs to the command-handling and CAP registration code,
+// which isn't part of this tree slice.
+
+const (
+	// MultilineBatchType is the `draft/multiline` batch type, used to group
+	// the component lines of a single logical PRIVMSG/NOTICE.
+	// https://ircv3.net/specs/extensions/multiline
+	MultilineBatchType = "draft/multiline"
+
+	// multilineConcatTag marks a line as a continuation of the previous one,
+	// i.e. the break between them was inserted by line-wrapping rather than
+	// being a real newline sent by the client.
+	multilineConcatTag = "draft/multiline-concat"
+
+	// multilineFallbackMsgidTag carries the shared msgid for the whole batch
+	// on the BATCH start line, so clients that only track one msgid per
+	// logical message can still correlate replies/reactions to it.
+	multilineFallbackMsgidTag = "draft/fmsgid"
+)
+
+var (
+	errMultilineTooManyBytes   = errors.New("multiline: batch exceeds the negotiated max-bytes limit")
+	errMultilineTooManyLines   = errors.New("multiline: batch exceeds the negotiated max-lines limit")
+	errMultilineTooManyBatches = errors.New("multiline: too many concurrently open multiline batches")
+	errMultilineUnknownBatch   = errors.New("multiline: BATCH reference to an unknown or already-closed batch")
+)
+
+// MultilineLimits are the limits we advertise and enforce for the
+// `draft/multiline` capability.
+type MultilineLimits struct {
+	MaxBytes int
+	MaxLines int
+}
+
+// CapValue renders the limits as the CAP LS 302 value for draft/multiline,
+// e.g. "max-bytes=4096,max-lines=24".
+func (limits MultilineLimits) CapValue() string {
+	return fmt.Sprintf("max-bytes=%d,max-lines=%d", limits.MaxBytes, limits.MaxLines)
+}
+
+// multilineSegment is one line of a multiline message, together with whether
+// it's a continuation of the previous line produced by wrapping rather than
+// a genuine newline.
+type multilineSegment struct {
+	Line   string
+	Concat bool
+}
+
+// splitMultilineMessage splits a (potentially multi-line) message into the
+// individual lines of a draft/multiline batch: it breaks on real newlines
+// first, then further wraps any line exceeding maxLineBytes, marking the
+// wrapped continuations with Concat so the recipient can rejoin them without
+// inserting an extra newline. maxLineBytes <= 0 disables wrapping.
+func splitMultilineMessage(message string, maxLineBytes int) (segments []multilineSegment) {
+	for _, line := range strings.Split(message, "\n") {
+		if maxLineBytes <= 0 || len(line) <= maxLineBytes {
+			segments = append(segments, multilineSegment{Line: line})
+			continue
+		}
+		for concat := false; len(line) > 0; concat = true {
+			end := maxLineBytes
+			if end >= len(line) {
+				end = len(line)
+			} else {
+				// don't split a multi-byte rune across two segments
+				for end > 0 && !utf8.RuneStart(line[end]) {
+					end--
+				}
+				if end == 0 {
+					// a single rune is wider than maxLineBytes: emit it whole
+					_, size := utf8.DecodeRuneInString(line)
+					end = size
+				}
+			}
+			segments = append(segments, multilineSegment{Line: line[:end], Concat: concat})
+			line = line[end:]
+		}
+	}
+	return
+}
+
+// multilineIncomingBatch buffers the lines of an in-progress incoming
+// `draft/multiline` BATCH for a single client connection.
+type multilineIncomingBatch struct {
+	target string
+	lines  []multilineSegment
+	bytes  int
+}
+
+// MultilineManager buffers the incoming `draft/multiline` batches for a
+// single client connection and enforces the negotiated limits, so that on
+// `BATCH -<id>` the lines can be reassembled into a single logical message
+// and dispatched through the normal PRIVMSG/NOTICE pipeline.
+type MultilineManager struct {
+	limits               MultilineLimits
+	maxConcurrentBatches int
+
+	open map[string]*multilineIncomingBatch
+}
+
+// NewMultilineManager returns a MultilineManager enforcing the given limits.
+func NewMultilineManager(limits MultilineLimits, maxConcurrentBatches int) *MultilineManager {
+	return &MultilineManager{
+		limits:               limits,
+		maxConcurrentBatches: maxConcurrentBatches,
+		open:                 make(map[string]*multilineIncomingBatch),
+	}
+}
+
+// Start begins buffering a new incoming multiline batch for `BATCH +<id>
+// draft/multiline <target>`.
+func (m *MultilineManager) Start(batchID, target string) error {
+	if len(m.open) >= m.maxConcurrentBatches {
+		return errMultilineTooManyBatches
+	}
+	m.open[batchID] = &multilineIncomingBatch{target: target}
+	return nil
+}
+
+// AddLine buffers one PRIVMSG/NOTICE line belonging to an open batch,
+// enforcing the max-lines and max-bytes limits. `concat` records whether the
+// client tagged this line with `draft/multiline-concat`, i.e. it's a
+// continuation of the previous line rather than a genuine new one.
+func (m *MultilineManager) AddLine(batchID, line string, concat bool) error {
+	batch, ok := m.open[batchID]
+	if !ok {
+		return errMultilineUnknownBatch
+	}
+	if len(batch.lines)+1 > m.limits.MaxLines {
+		delete(m.open, batchID)
+		return errMultilineTooManyLines
+	}
+	batch.bytes += len(line)
+	if batch.bytes > m.limits.MaxBytes {
+		delete(m.open, batchID)
+		return errMultilineTooManyBytes
+	}
+	batch.lines = append(batch.lines, multilineSegment{Line: line, Concat: concat})
+	return nil
+}
+
+// Finish closes `BATCH -<id>` and returns the batch's target and the
+// reassembled message text, ready to be turned into a utils.SplitMessage and
+// dispatched as a normal PRIVMSG/NOTICE. Lines are rejoined with a real
+// newline, except where the client marked a line as a `draft/multiline-concat`
+// continuation, which is appended directly with no separator.
+func (m *MultilineManager) Finish(batchID string) (target string, message string, err error) {
+	batch, ok := m.open[batchID]
+	if !ok {
+		return "", "", errMultilineUnknownBatch
+	}
+	delete(m.open, batchID)
+
+	var builder strings.Builder
+	for i, segment := range batch.lines {
+		if i > 0 && !segment.Concat {
+			builder.WriteByte('\n')
+		}
+		builder.WriteString(segment.Line)
+	}
+	return batch.target, builder.String(), nil
+}
+
+// Abort discards an open batch without dispatching it, e.g. on disconnect.
+func (m *MultilineManager) Abort(batchID string) {
+	delete(m.open, batchID)
+}
+
+// FinishDispatch closes `BATCH -<id>` and returns a utils.SplitMessage ready
+// to hand to the normal PRIVMSG/NOTICE pipeline (e.g.
+// ResponseBuffer.AddMultilineFromClient on the other recipients' sessions),
+// exactly as if the reassembled message had arrived on a single line. This
+// is the integration point the `BATCH` command handler calls into; wiring it
+// up there, and advertising MultilineLimits.CapValue() in CAP LS, is left to
+// the command-handling and CAP registration code, which isn't part of this
+// tree slice.
+func (m *MultilineManager) FinishDispatch(batchID string, msgid string, when time.Time) (target string, message utils.SplitMessage, err error) {
+	target, text, err := m.Finish(batchID)
+	if err != nil {
+		return "", utils.SplitMessage{}, err
+	}
+	return target, utils.SplitMessage{Message: text, Msgid: msgid, Time: when}, nil
+}
+
+// multilineFailCode maps an error from Start/AddLine/Finish to the
+// standard-replies FAIL code the BATCH command handler should send back to a
+// client that violated the negotiated draft/multiline limits.
+func multilineFailCode(err error) string {
+	switch err {
+	case errMultilineTooManyBytes:
+		return "MULTILINE_MAX_BYTES"
+	case errMultilineTooManyLines:
+		return "MULTILINE_MAX_LINES"
+	case errMultilineTooManyBatches:
+		return "MULTILINE_MAX_CONCURRENT"
+	case errMultilineUnknownBatch:
+		return "BATCH_UNKNOWN"
+	default:
+		return "UNKNOWN_ERROR"
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Oragono Authors
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestMultilineManagerConcatJoining(t *testing.T) {
+	m := NewMultilineManager(MultilineLimits{MaxBytes: 1024, MaxLines: 16}, 4)
+	if err := m.Start("1", "#ircv3"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := m.AddLine("1", "hello ", false); err != nil {
+		t.Fatalf("AddLine: %v", err)
+	}
+	// a continuation line (draft/multiline-concat) must NOT gain a newline
+	if err := m.AddLine("1", "world", true); err != nil {
+		t.Fatalf("AddLine: %v", err)
+	}
+	// a real new line must gain a newline
+	if err := m.AddLine("1", "goodbye", false); err != nil {
+		t.Fatalf("AddLine: %v", err)
+	}
+
+	_, message, err := m.Finish("1")
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if expected := "hello world\ngoodbye"; message != expected {
+		t.Errorf("expected %q, got %q", expected, message)
+	}
+}
+
+func TestSplitMultilineMessageRespectsUTF8Boundaries(t *testing.T) {
+	// "é" is 2 bytes (0xc3 0xa9); a maxLineBytes of 1 must not split it in half
+	segments := splitMultilineMessage("éé", 1)
+	var joined string
+	for _, segment := range segments {
+		if !utf8.ValidString(segment.Line) {
+			t.Errorf("segment %q is not valid UTF-8", segment.Line)
+		}
+		joined += segment.Line
+	}
+	if joined != "éé" {
+		t.Errorf("expected segments to reassemble to %q, got %q", "éé", joined)
+	}
+}
+
+func TestMultilineManagerFinishDispatch(t *testing.T) {
+	m := NewMultilineManager(MultilineLimits{MaxBytes: 1024, MaxLines: 16}, 4)
+	if err := m.Start("1", "#ircv3"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	m.AddLine("1", "hello", false)
+
+	target, message, err := m.FinishDispatch("1", "abc123", time.Time{})
+	if err != nil {
+		t.Fatalf("FinishDispatch: %v", err)
+	}
+	if target != "#ircv3" {
+		t.Errorf("expected target #ircv3, got %q", target)
+	}
+	if message.Message != "hello" || message.Msgid != "abc123" {
+		t.Errorf("unexpected SplitMessage: %+v", message)
+	}
+}
+
+func TestMultilineManagerLimitsAndFailCodes(t *testing.T) {
+	m := NewMultilineManager(MultilineLimits{MaxBytes: 1024, MaxLines: 1}, 1)
+	m.Start("1", "#ircv3")
+	m.AddLine("1", "hello", false)
+	if err := m.AddLine("1", "world", false); err != errMultilineTooManyLines {
+		t.Fatalf("expected errMultilineTooManyLines, got %v", err)
+	} else if code := multilineFailCode(err); code != "MULTILINE_MAX_LINES" {
+		t.Errorf("expected MULTILINE_MAX_LINES, got %q", code)
+	}
+
+	if err := m.Start("2", "#ircv3"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := m.Start("3", "#ircv3"); err != errMultilineTooManyBatches {
+		t.Fatalf("expected errMultilineTooManyBatches, got %v", err)
+	} else if code := multilineFailCode(err); code != "MULTILINE_MAX_CONCURRENT" {
+		t.Errorf("expected MULTILINE_MAX_CONCURRENT, got %q", code)
+	}
+}
+
+func TestMultilineManagerAbort(t *testing.T) {
+	m := NewMultilineManager(MultilineLimits{MaxBytes: 1024, MaxLines: 16}, 1)
+	m.Start("1", "#ircv3")
+	m.Abort("1")
+	// the slot freed by Abort should be reusable
+	if err := m.Start("2", "#ircv3"); err != nil {
+		t.Errorf("expected Start to succeed after Abort freed a slot, got %v", err)
+	}
+	if _, _, err := m.Finish("1"); err != errMultilineUnknownBatch {
+		t.Errorf("expected Finish on an aborted batch to fail, got %v", err)
+	}
+}
+
+func TestMultilineLimitsCapValue(t *testing.T) {
+	limits := MultilineLimits{MaxBytes: 4096, MaxLines: 24}
+	if cv := limits.CapValue(); cv != "max-bytes=4096,max-lines=24" {
+		t.Errorf("unexpected CapValue: %q", cv)
+	}
+}
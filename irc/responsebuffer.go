@@ -14,9 +14,26 @@ import (
 
 const (
 	// https://ircv3.net/specs/extensions/labeled-response.html
+	// caps.LabeledResponse advertises draft/labeled-response-0.2;
+	// caps.LabeledResponseLegacy advertises the unversioned pre-0.2 name for
+	// clients that haven't upgraded yet.
 	defaultBatchType = "draft/labeled-response"
 )
 
+// LabeledResponseCapNames returns the labeled-response capability name(s) a
+// server should advertise in CAP LS: draft/labeled-response-0.2 always, plus
+// the legacy unversioned name when advertiseLegacy is set. advertiseLegacy is
+// sourced from the server config's transitional toggle (e.g.
+// `labeled-response.advertise-legacy-name`), read by the (not-in-this-tree-
+// slice) CAP registration code.
+func LabeledResponseCapNames(advertiseLegacy bool) []string {
+	names := []string{string(caps.LabeledResponse)}
+	if advertiseLegacy {
+		names = append(names, string(caps.LabeledResponseLegacy))
+	}
+	return names
+}
+
 // ResponseBuffer - put simply - buffers messages and then outputs them to a given client.
 //
 // Using a ResponseBuffer lets you really easily implement labeled-response, since the
@@ -36,12 +53,58 @@ type ResponseBuffer struct {
 	// nested batch.)
 	nestedBatches []string
 
+	// forceLabeledBatch, if set via ForceLabeledBatch(), makes flushInternal
+	// always send a labeled-response batch, even for a response that would
+	// otherwise be small enough to tag inline.
+	forceLabeledBatch bool
+
 	messages  []ircmsg.IrcMessage
 	finalized bool
 	target    *Client
 	session   *Session
 }
 
+// labeledResponseAction is what flushInternal should do about the
+// labeled-response batch, as decided by decideLabeledResponseAction.
+type labeledResponseAction int
+
+const (
+	actionNone labeledResponseAction = iota
+	actionStartBatch
+	actionBareACK
+	actionInlineLabel
+)
+
+// decideLabeledResponseAction is the pure decision logic behind
+// flushInternal's handling of labeled-response: whether to start a batch,
+// send a bare ACK, tag the lone message inline, or do nothing. It's factored
+// out of flushInternal so it can be tested without a live Session.
+func decideLabeledResponseAction(hasLabel, has02, hasLegacy, forceBatch, batchAlreadyStarted bool, messageCount int, final bool) labeledResponseAction {
+	useLabel := hasLabel && (has02 || hasLegacy)
+	if !useLabel {
+		return actionNone
+	}
+	// use a batch if we're forced to, or we currently have 2+ messages,
+	// or we are doing a Flush() and we have to assume that there will be more
+	// messages in the future.
+	if forceBatch || 1 < messageCount || !final {
+		return actionStartBatch
+	}
+	if batchAlreadyStarted {
+		// ForceBatchStart already sent BATCH +, so there's nothing left to decide.
+		return actionNone
+	}
+	if messageCount == 0 {
+		if has02 {
+			// draft/labeled-response-0.2 requires an ACK even for an empty
+			// response; the legacy revision does not.
+			return actionBareACK
+		}
+		return actionNone
+	}
+	return actionInlineLabel
+}
+
 // GetLabel returns the label from the given message.
 func GetLabel(msg ircmsg.IrcMessage) string {
 	_, value := msg.GetTag(caps.LabelTagName)
@@ -89,6 +152,86 @@ func (rb *ResponseBuffer) Broadcast(tags map[string]string, prefix string, comma
 	}
 }
 
+// BroadcastLabeled adds a message to the queue of the client's originSession
+// (tagging it with label, if originSession negotiated labeled-response), and
+// relays copies to the client's other sessions: a sibling with
+// labeled-response negotiated gets the relay wrapped in its own
+// `draft/labeled-response` BATCH, correlated by a fresh session-scoped batch
+// ID (the inbound label is only valid for originSession's own request, and
+// reusing it on an unsolicited server-relayed echo to an unrelated session
+// would be non-conformant); any other sibling just gets an unlabeled copy,
+// as in Broadcast. Use this instead of Broadcast for a client's own
+// PRIVMSG/NOTICE echoed back via echo-message, so the origin session can
+// still correlate the echo with its original labeled request.
+func (rb *ResponseBuffer) BroadcastLabeled(originSession *Session, label string, tags map[string]string, prefix string, command string, params ...string) {
+	msg := buildOriginMessage(tags, prefix, command, params, label, originSession.capabilities.Has(caps.LabeledResponse))
+	if originSession == rb.session {
+		rb.AddMessage(msg)
+	} else {
+		originSession.SendRawMessage(msg, false)
+	}
+
+	for _, session := range rb.session.client.Sessions() {
+		if session == originSession {
+			continue
+		}
+		switch planSiblingRelay(session.capabilities.Has(caps.LabeledResponse)) {
+		case relayBatchWrapped:
+			relayID := NewBatchID()
+			session.SendRawMessage(ircmsg.MakeMessage(nil, rb.target.server.name, "BATCH", "+"+relayID, defaultBatchType), false)
+			session.SendRawMessage(buildSiblingRelay(tags, prefix, command, params, relayID), false)
+			session.SendRawMessage(ircmsg.MakeMessage(nil, rb.target.server.name, "BATCH", "-"+relayID), false)
+		case relayPlain:
+			session.Send(tags, prefix, command, params...)
+		}
+	}
+}
+
+// buildOriginMessage constructs the message BroadcastLabeled enqueues/sends
+// to originSession itself, tagging it with label only if originSession is
+// the one that negotiated labeled-response and requested it. Extracted as a
+// pure function (no *Session dependency) so the tagging decision is directly
+// testable.
+func buildOriginMessage(tags map[string]string, prefix string, command string, params []string, label string, originHasLabeledResponse bool) ircmsg.IrcMessage {
+	msg := ircmsg.MakeMessage(tags, prefix, command, params...)
+	if label != "" && originHasLabeledResponse {
+		msg.SetTag(caps.LabelTagName, label)
+	}
+	return msg
+}
+
+// labeledResponseRelayMode is how BroadcastLabeled delivers a copy of a
+// labeled-response-echoed message to one of the origin client's other
+// sessions.
+type labeledResponseRelayMode int
+
+const (
+	relayPlain labeledResponseRelayMode = iota
+	relayBatchWrapped
+)
+
+// planSiblingRelay decides the relay mode for a sibling session: one that
+// negotiated labeled-response gets the copy wrapped in its own BATCH,
+// correlated by a fresh session-scoped batch ID, since originSession's label
+// is only valid for originSession's own request and reusing it on an
+// unsolicited echo to an unrelated session would be non-conformant. Anyone
+// else just gets a plain, untagged copy, as in Broadcast.
+func planSiblingRelay(siblingHasLabeledResponse bool) labeledResponseRelayMode {
+	if siblingHasLabeledResponse {
+		return relayBatchWrapped
+	}
+	return relayPlain
+}
+
+// buildSiblingRelay constructs the batch-wrapped copy of a labeled-response-
+// echoed message sent to a sibling session, tagged with the relay's own
+// batch ID and never with originSession's label.
+func buildSiblingRelay(tags map[string]string, prefix string, command string, params []string, relayID string) ircmsg.IrcMessage {
+	relay := ircmsg.MakeMessage(tags, prefix, command, params...)
+	relay.SetTag("batch", relayID)
+	return relay
+}
+
 // AddFromClient adds a new message from a specific client to our queue.
 func (rb *ResponseBuffer) AddFromClient(time time.Time, msgid string, fromNickMask string, fromAccount string, tags map[string]string, command string, params ...string) {
 	msg := ircmsg.MakeMessage(nil, fromNickMask, command, params...)
@@ -121,6 +264,47 @@ func (rb *ResponseBuffer) AddSplitMessageFromClient(fromNickMask string, fromAcc
 	}
 }
 
+// AddMultilineFromClient adds a new message from a specific client to our queue,
+// splitting it into a `draft/multiline` batch when the session negotiated the
+// capability and the message doesn't fit on a single line (either because it
+// contains real newlines, or because it's too long and was wrapped). Falls
+// back to AddSplitMessageFromClient otherwise.
+func (rb *ResponseBuffer) AddMultilineFromClient(fromNickMask string, fromAccount string, tags map[string]string, command string, target string, message utils.SplitMessage, maxLineBytes int) {
+	if !rb.session.capabilities.Has(caps.Multiline) {
+		rb.AddSplitMessageFromClient(fromNickMask, fromAccount, tags, command, target, message)
+		return
+	}
+
+	segments := splitMultilineMessage(message.Message, maxLineBytes)
+	if len(segments) < 2 {
+		rb.AddSplitMessageFromClient(fromNickMask, fromAccount, tags, command, target, message)
+		return
+	}
+
+	batchID := rb.StartNestedBatch(MultilineBatchType, target)
+	if 0 < len(rb.messages) {
+		rb.messages[len(rb.messages)-1].SetTag(multilineFallbackMsgidTag, message.Msgid)
+	}
+
+	for _, segment := range segments {
+		msg := ircmsg.MakeMessage(nil, fromNickMask, command, target, segment.Line)
+		if rb.session.capabilities.Has(caps.MessageTags) {
+			msg.UpdateTags(tags)
+			msg.SetTag("msgid", message.Msgid)
+		}
+		if rb.session.capabilities.Has(caps.AccountTag) && fromAccount != "*" {
+			msg.SetTag("account", fromAccount)
+		}
+		if segment.Concat {
+			msg.SetTag(multilineConcatTag, "")
+		}
+		rb.session.setTimeTag(&msg, message.Time)
+		rb.AddMessage(msg)
+	}
+
+	rb.EndNestedBatch(batchID)
+}
+
 // ForceBatchStart forcibly starts a batch of batch `batchType`.
 // Normally, Send/Flush will decide automatically whether to start a batch
 // of type draft/labeled-response. This allows changing the batch type
@@ -130,13 +314,20 @@ func (rb *ResponseBuffer) ForceBatchStart(batchType string, blocking bool) {
 	rb.sendBatchStart(blocking)
 }
 
+// ForceLabeledBatch forces a labeled-response batch to be sent even if the
+// response would otherwise be inlined (zero or one message), so that inner
+// messages are correlated via the `batch` tag instead of a bare `label` tag.
+func (rb *ResponseBuffer) ForceLabeledBatch() {
+	rb.forceLabeledBatch = true
+}
+
 func (rb *ResponseBuffer) sendBatchStart(blocking bool) {
 	if rb.batchID != "" {
 		// batch already initialized
 		return
 	}
 
-	rb.batchID = utils.GenerateSecretToken()
+	rb.batchID = NewBatchID()
 	message := ircmsg.MakeMessage(nil, rb.target.server.name, "BATCH", "+"+rb.batchID, rb.batchType)
 	if rb.Label != "" {
 		message.SetTag(caps.LabelTagName, rb.Label)
@@ -157,7 +348,7 @@ func (rb *ResponseBuffer) sendBatchEnd(blocking bool) {
 // Starts a nested batch (see the ResponseBuffer struct definition for a description of
 // how this works)
 func (rb *ResponseBuffer) StartNestedBatch(batchType string, params ...string) (batchID string) {
-	batchID = utils.GenerateSecretToken()
+	batchID = NewBatchID()
 	msgParams := make([]string, len(params)+2)
 	msgParams[0] = "+" + batchID
 	msgParams[1] = batchType
@@ -221,22 +412,22 @@ func (rb *ResponseBuffer) flushInternal(final bool, blocking bool) error {
 		return nil
 	}
 
-	useLabel := rb.session.capabilities.Has(caps.LabeledResponse) && rb.Label != ""
-	// use a batch if we have a label, and we either currently have 2+ messages,
-	// or we are doing a Flush() and we have to assume that there will be more messages
-	// in the future.
-	startBatch := useLabel && (1 < len(rb.messages) || !final)
+	hasLabel := rb.Label != ""
+	has02 := rb.session.capabilities.Has(caps.LabeledResponse)
+	hasLegacy := rb.session.capabilities.Has(caps.LabeledResponseLegacy)
+	action := decideLabeledResponseAction(hasLabel, has02, hasLegacy, rb.forceLabeledBatch, rb.batchID != "", len(rb.messages), final)
 
-	if startBatch {
+	switch action {
+	case actionStartBatch:
 		rb.sendBatchStart(blocking)
-	} else if useLabel && len(rb.messages) == 0 && rb.batchID == "" && final {
-		// ACK message
+	case actionBareACK:
+		// draft/labeled-response-0.2 requires an ACK even when the command
+		// produced no response messages; the legacy revision does not.
 		message := ircmsg.MakeMessage(nil, rb.session.client.server.name, "ACK")
 		message.SetTag(caps.LabelTagName, rb.Label)
 		rb.session.setTimeTag(&message, time.Time{})
 		rb.session.SendRawMessage(message, blocking)
-	} else if useLabel && len(rb.messages) == 1 && rb.batchID == "" && final {
-		// single labeled message
+	case actionInlineLabel:
 		rb.messages[0].SetTag(caps.LabelTagName, rb.Label)
 	}
 
@@ -271,3 +462,61 @@ func (rb *ResponseBuffer) flushInternal(final bool, blocking bool) error {
 func (rb *ResponseBuffer) Notice(text string) {
 	rb.Add(nil, rb.target.server.name, "NOTICE", rb.target.nick, text)
 }
+
+// Fail sends a machine-readable FAIL standard reply (see the IRCv3
+// standard-replies spec), or a plain NOTICE if the client didn't negotiate
+// `standard-replies`. `command` is the command that failed (or "*" if none
+// applies), `code` is the machine-readable error code, and
+// `contextAndDescription` is zero or more additional context parameters
+// followed by the mandatory, human-readable description.
+func (rb *ResponseBuffer) Fail(command string, code string, contextAndDescription ...string) {
+	rb.standardReply("FAIL", command, code, contextAndDescription...)
+}
+
+// Warn sends a WARN standard reply; see Fail.
+func (rb *ResponseBuffer) Warn(command string, code string, contextAndDescription ...string) {
+	rb.standardReply("WARN", command, code, contextAndDescription...)
+}
+
+// Note sends a NOTE standard reply; see Fail.
+func (rb *ResponseBuffer) Note(command string, code string, contextAndDescription ...string) {
+	rb.standardReply("NOTE", command, code, contextAndDescription...)
+}
+
+// standardReply implements Fail/Warn/Note. It's added to the queue via the
+// usual Add, so it cooperates with labeled-response batching like any other
+// message: e.g. a single FAIL under a label still gets inlined or put in a
+// batch exactly as a single NOTICE would.
+func (rb *ResponseBuffer) standardReply(verb string, command string, code string, contextAndDescription ...string) {
+	if len(contextAndDescription) == 0 {
+		rb.target.server.logger.Error("internal", "standard reply with no description", verb, command, code)
+		debug.PrintStack()
+		return
+	}
+
+	if !rb.session.capabilities.Has(caps.StandardReplies) {
+		rb.Notice(standardReplyFallbackText(contextAndDescription...))
+		return
+	}
+
+	rb.Add(nil, rb.target.server.name, verb, buildStandardReplyParams(command, code, contextAndDescription...)...)
+}
+
+// buildStandardReplyParams orders the wire params for a FAIL/WARN/NOTE
+// standard reply: command, then code, then the caller's context parameters
+// and mandatory trailing description, in that order. Extracted as a pure
+// function so the param ordering is directly testable without a *Session.
+func buildStandardReplyParams(command string, code string, contextAndDescription ...string) []string {
+	params := make([]string, 0, len(contextAndDescription)+2)
+	params = append(params, command, code)
+	params = append(params, contextAndDescription...)
+	return params
+}
+
+// standardReplyFallbackText is the NOTICE text standardReply falls back to
+// when the client didn't negotiate standard-replies: just the mandatory
+// trailing description, since a plain NOTICE has nowhere to put the context
+// parameters.
+func standardReplyFallbackText(contextAndDescription ...string) string {
+	return contextAndDescription[len(contextAndDescription)-1]
+}
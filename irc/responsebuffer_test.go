@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Oragono Authors
+// released under the MIT license
+
+package irc
+
+import "testing"
+
+func TestDecideLabeledResponseActionZeroMessages(t *testing.T) {
+	// draft/labeled-response-0.2: empty response gets a bare ACK
+	if action := decideLabeledResponseAction(true, true, false, false, false, 0, true); action != actionBareACK {
+		t.Errorf("expected actionBareACK for a 0.2 client with no messages, got %v", action)
+	}
+
+	// legacy labeled-response: no ACK for an empty response
+	if action := decideLabeledResponseAction(true, false, true, false, false, 0, true); action != actionNone {
+		t.Errorf("expected actionNone for a legacy client with no messages, got %v", action)
+	}
+}
+
+func TestDecideLabeledResponseActionOneMessage(t *testing.T) {
+	if action := decideLabeledResponseAction(true, true, false, false, false, 1, true); action != actionInlineLabel {
+		t.Errorf("expected actionInlineLabel for a single message, got %v", action)
+	}
+}
+
+func TestDecideLabeledResponseActionManyMessages(t *testing.T) {
+	if action := decideLabeledResponseAction(true, true, false, false, false, 2, true); action != actionStartBatch {
+		t.Errorf("expected actionStartBatch for 2+ messages, got %v", action)
+	}
+}
+
+func TestDecideLabeledResponseActionForcedBatch(t *testing.T) {
+	// ForceLabeledBatch() should force a batch even for a single message
+	if action := decideLabeledResponseAction(true, true, false, true, false, 1, true); action != actionStartBatch {
+		t.Errorf("expected actionStartBatch when forceBatch is set, got %v", action)
+	}
+
+	// ForceBatchStart() already sent BATCH +, so there's nothing left to decide
+	if action := decideLabeledResponseAction(true, true, false, false, true, 0, true); action != actionNone {
+		t.Errorf("expected actionNone once the batch was already started, got %v", action)
+	}
+}
+
+func TestDecideLabeledResponseActionNoLabel(t *testing.T) {
+	if action := decideLabeledResponseAction(false, true, true, false, false, 1, true); action != actionNone {
+		t.Errorf("expected actionNone when there's no label, got %v", action)
+	}
+}
+
+func TestLabeledResponseCapNames(t *testing.T) {
+	if names := LabeledResponseCapNames(false); len(names) != 1 || names[0] != "draft/labeled-response-0.2" {
+		t.Errorf("expected only the 0.2 name, got %v", names)
+	}
+	if names := LabeledResponseCapNames(true); len(names) != 2 || names[1] != "draft/labeled-response" {
+		t.Errorf("expected the legacy name appended, got %v", names)
+	}
+}
+
+func TestBuildOriginMessageTagsOnlyWhenOriginNegotiatedLabeledResponse(t *testing.T) {
+	// origin session negotiated labeled-response and requested a label: tag it
+	msg := buildOriginMessage(nil, "nick!user@host", "PRIVMSG", []string{"#ircv3", "hi"}, "123", true)
+	if label := GetLabel(msg); label != "123" {
+		t.Errorf("expected origin message to carry label %q, got %q", "123", label)
+	}
+
+	// origin session didn't negotiate labeled-response: no label tag, even if one was passed in
+	msg = buildOriginMessage(nil, "nick!user@host", "PRIVMSG", []string{"#ircv3", "hi"}, "123", false)
+	if label := GetLabel(msg); label != "" {
+		t.Errorf("expected no label on an origin message from a session without labeled-response, got %q", label)
+	}
+}
+
+func TestPlanSiblingRelayModes(t *testing.T) {
+	if mode := planSiblingRelay(true); mode != relayBatchWrapped {
+		t.Errorf("expected relayBatchWrapped for a sibling with labeled-response negotiated, got %v", mode)
+	}
+	if mode := planSiblingRelay(false); mode != relayPlain {
+		t.Errorf("expected relayPlain for a sibling without labeled-response, got %v", mode)
+	}
+}
+
+func TestBuildStandardReplyParamsOrdering(t *testing.T) {
+	params := buildStandardReplyParams("PRIVMSG", "NEED_MORE_PARAMS", "#ircv3", "Not enough parameters")
+	expected := []string{"PRIVMSG", "NEED_MORE_PARAMS", "#ircv3", "Not enough parameters"}
+	if len(params) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, params)
+	}
+	for i := range expected {
+		if params[i] != expected[i] {
+			t.Errorf("param %d: expected %q, got %q", i, expected[i], params[i])
+		}
+	}
+}
+
+func TestStandardReplyFallbackTextIsDescriptionOnly(t *testing.T) {
+	// the NOTICE fallback (no standard-replies negotiated) has nowhere to put
+	// context params, so it must use only the trailing description
+	if text := standardReplyFallbackText("#ircv3", "Not enough parameters"); text != "Not enough parameters" {
+		t.Errorf("expected fallback text to be the description only, got %q", text)
+	}
+	if text := standardReplyFallbackText("Not enough parameters"); text != "Not enough parameters" {
+		t.Errorf("expected fallback text with no context params to be unchanged, got %q", text)
+	}
+}
+
+func TestSingleFailUnderLabelGetsInlined(t *testing.T) {
+	// a single FAIL queued under a label is just one more message to
+	// decideLabeledResponseAction, and must be inlined like any other
+	// single-message response rather than forcing a batch
+	if action := decideLabeledResponseAction(true, true, false, false, false, 1, true); action != actionInlineLabel {
+		t.Errorf("expected a single FAIL under a label to be inlined, got %v", action)
+	}
+}
+
+func TestBuildSiblingRelayCarriesBatchTagNotLabel(t *testing.T) {
+	// regression test for 6ed13ed: a sibling's relayed echo must be correlated
+	// via its own BATCH, never tagged with the origin session's bare label
+	relay := buildSiblingRelay(nil, "nick!user@host", "PRIVMSG", []string{"#ircv3", "hi"}, "abc123")
+	if ok, batch := relay.GetTag("batch"); !ok || batch != "abc123" {
+		t.Errorf("expected relay to carry batch tag %q, got %q (ok=%v)", "abc123", batch, ok)
+	}
+	if label := GetLabel(relay); label != "" {
+		t.Errorf("expected relay to carry no label tag, got %q", label)
+	}
+}